@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+func TestWhoAmIReturnsErrNoIdentityWhenUnset(t *testing.T) {
+	m := &CredentialsExpirationManager{}
+
+	if _, err := m.WhoAmI(); err != errNoIdentity {
+		t.Fatalf("err = %v, want errNoIdentity", err)
+	}
+}
+
+func TestWhoAmIReturnsSourceIdentity(t *testing.T) {
+	identity := &sts.GetCallerIdentityOutput{Account: aws.String("123456789012")}
+	m := &CredentialsExpirationManager{sourceIdentity: identity}
+
+	got, err := m.WhoAmI()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != identity {
+		t.Fatalf("WhoAmI() = %v, want %v", got, identity)
+	}
+}
+
+func TestVerifyAccountMatchSkipsWhenNoIdentityYet(t *testing.T) {
+	m := &CredentialsExpirationManager{}
+
+	if err := m.verifyAccountMatch(Profile{AccountID: "123456789012"}); err != nil {
+		t.Fatalf("unexpected error with no source identity: %v", err)
+	}
+}
+
+func TestVerifyAccountMatchSkipsWhenProfileDeclaresNoExpectation(t *testing.T) {
+	m := &CredentialsExpirationManager{
+		sourceIdentity: &sts.GetCallerIdentityOutput{Account: aws.String("123456789012")},
+	}
+
+	if err := m.verifyAccountMatch(Profile{}); err != nil {
+		t.Fatalf("unexpected error for profile with no account_id/mfa_serial: %v", err)
+	}
+}
+
+func TestVerifyAccountMatchAcceptsMatchingAccountID(t *testing.T) {
+	m := &CredentialsExpirationManager{
+		sourceIdentity: &sts.GetCallerIdentityOutput{Account: aws.String("123456789012")},
+	}
+
+	if err := m.verifyAccountMatch(Profile{AccountID: "123456789012"}); err != nil {
+		t.Fatalf("unexpected error for matching account_id: %v", err)
+	}
+}
+
+func TestVerifyAccountMatchRejectsMismatchedAccountID(t *testing.T) {
+	m := &CredentialsExpirationManager{
+		sourceIdentity:    &sts.GetCallerIdentityOutput{Account: aws.String("999999999999")},
+		sourceProfileName: "default",
+	}
+
+	err := m.verifyAccountMatch(Profile{AccountID: "123456789012"})
+	if err == nil {
+		t.Fatal("expected error for mismatched account_id, got nil")
+	}
+}
+
+func TestVerifyAccountMatchFallsBackToMFASerialAccount(t *testing.T) {
+	m := &CredentialsExpirationManager{
+		sourceIdentity: &sts.GetCallerIdentityOutput{Account: aws.String("999999999999")},
+	}
+
+	err := m.verifyAccountMatch(Profile{MFASerial: "arn:aws:iam::123456789012:mfa/jdoe"})
+	if err == nil {
+		t.Fatal("expected error when mfa_serial account doesn't match resolved identity, got nil")
+	}
+
+	m.sourceIdentity = &sts.GetCallerIdentityOutput{Account: aws.String("123456789012")}
+	if err := m.verifyAccountMatch(Profile{MFASerial: "arn:aws:iam::123456789012:mfa/jdoe"}); err != nil {
+		t.Fatalf("unexpected error when mfa_serial account matches resolved identity: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -16,11 +17,17 @@ import (
 
 // Common errors for credential manager
 var (
-	ErrMissingProfileDefault = fmt.Errorf("missing profile: default")
-	errMFANeeded             = fmt.Errorf("MFA needed")
-	errBaseMFANeeded         = fmt.Errorf("Base MFA needed")
-	errUnknownProfile        = fmt.Errorf("Unknown profile")
-	errSourceSessionExpired  = fmt.Errorf("Source session expired")
+	ErrMissingProfileDefault  = fmt.Errorf("missing profile: default")
+	errMFANeeded              = fmt.Errorf("MFA needed")
+	errBaseMFANeeded          = fmt.Errorf("Base MFA needed")
+	errUnknownProfile         = fmt.Errorf("Unknown profile")
+	errSourceSessionExpired   = fmt.Errorf("Source session expired")
+	errWebIdentityTokenEmpty  = fmt.Errorf("web identity token file produced no token")
+	errWebIdentityTokenSource = fmt.Errorf("profile declares both a web identity token and static keys")
+	errSSOTokenMissing        = fmt.Errorf("no cached AWS SSO token found, run `aws sso login` for this profile")
+	errSSOTokenExpired        = fmt.Errorf("cached AWS SSO token has expired, run `aws sso login` for this profile")
+	errCredentialProcessEmpty = fmt.Errorf("credential_process produced no output")
+	errNoIdentity             = fmt.Errorf("no cached caller identity, source profile not set yet")
 )
 
 type fatalError struct {
@@ -46,11 +53,18 @@ func isFatalError(err error) bool {
 type CredentialsManager interface {
 	Role() string
 	RetrieveRole(name, MFA string) (*sts.Credentials, error)
-	RetrieveRoleARN(RoleARN, MFASerial, MFA string) (*sts.Credentials, error)
+	RetrieveRoleWithContext(ctx context.Context, name, MFA string) (*sts.Credentials, error)
+	RetrieveRoleARN(RoleARN, MFASerial, MFA string, durationSeconds int64) (*sts.Credentials, error)
+	RetrieveRoleARNWithContext(ctx context.Context, RoleARN, MFASerial, MFA string, durationSeconds int64) (*sts.Credentials, error)
 	AssumeRole(name, mfa string) error
-	AssumeRoleARN(name, RoleARN, MFASerial, MFA string) error
+	AssumeRoleWithContext(ctx context.Context, name, mfa string) error
+	AssumeRoleARN(name, RoleARN, MFASerial, MFA string, durationSeconds int64) error
+	AssumeRoleARNWithContext(ctx context.Context, name, RoleARN, MFASerial, MFA string, durationSeconds int64) error
 	GetCredentials() (*sts.Credentials, error)
+	GetCredentialsWithContext(ctx context.Context) (*sts.Credentials, error)
 	SetSourceProfile(name, mfa string) error
+	SetSourceProfileWithContext(ctx context.Context, name, mfa string) error
+	WhoAmI() (*sts.GetCallerIdentityOutput, error)
 }
 
 // CredentialsExpirationManager is responsible for renewing a set of credentials
@@ -72,9 +86,18 @@ type CredentialsExpirationManager struct {
 	sourceCredentials *sts.Credentials
 	sourceSTSClient   *sts.STS
 
+	// sourceIdentity is the caller identity of sourceCredentials, fetched via
+	// sts:GetCallerIdentity right after SetSourceProfile resolves them. Used
+	// to detect when a profile's declared account doesn't match the account
+	// the credentials actually resolved to.
+	sourceIdentity *sts.GetCallerIdentityOutput
+
 	// This is the current active credentials
 	role        string
 	credentials *sts.Credentials
+
+	// cancelRefresher stops the background Refresher goroutine, see Stop.
+	cancelRefresher context.CancelFunc
 }
 
 // NewCredentialsExpirationManager returns a credentialsExpirationManager
@@ -93,23 +116,33 @@ func NewCredentialsExpirationManager(profileName string, conf Config, mfa string
 		}
 	}
 
-	go cm.Refresher()
+	ctx, cancel := context.WithCancel(context.Background())
+	cm.cancelRefresher = cancel
+	go cm.Refresher(ctx)
 	return cm
 }
 
+// Stop cancels the background Refresher goroutine, so it can shut down
+// gracefully instead of running forever.
+func (m *CredentialsExpirationManager) Stop() {
+	if m.cancelRefresher != nil {
+		m.cancelRefresher()
+	}
+}
+
 // SetSourceProfile updates the credentials manager with new soruce profile.
 // This operation will also update the current profile to the source profile
 func (m *CredentialsExpirationManager) SetSourceProfile(name, mfa string) error {
+	return m.SetSourceProfileWithContext(context.Background(), name, mfa)
+}
+
+// SetSourceProfileWithContext is SetSourceProfile with a caller-supplied
+// context, so a stuck upstream STS/MFA/SSO call can be cancelled instead of
+// holding m.lock forever.
+func (m *CredentialsExpirationManager) SetSourceProfileWithContext(ctx context.Context, name, mfa string) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	fatal := false
-	checkErr := func(err error) error {
-		if fatal {
-			return makeFatal(err)
-		}
-		return err
-	}
 	m.err = nil
 
 	log.Printf("Setting base profile: %v", name)
@@ -122,54 +155,87 @@ func (m *CredentialsExpirationManager) SetSourceProfile(name, mfa string) error
 		return errUnknownProfile
 	}
 
-	sess := session.New(&aws.Config{
-		Region: &profile.Region,
-		Credentials: credentials.NewStaticCredentials(
-			profile.AwsAccessKeyID,
-			profile.AwsSecretAccessKey,
-			profile.AwsSessionToken,
-		),
-	})
-	stsClient := sts.New(sess)
-
-	if profile.MFASerial != "" && mfa == "" {
-		m.err = errMFANeeded
-		return errMFANeeded
-	}
-
-	sessionTokenInput := &sts.GetSessionTokenInput{
-		DurationSeconds: aws.Int64(10 * 3600),
-	}
-
-	if profile.MFASerial != "" {
-		sessionTokenInput.SerialNumber = aws.String(profile.MFASerial)
-	}
-	if mfa != "" {
-		sessionTokenInput.TokenCode = aws.String(mfa)
-		fatal = true
-	}
-
-	sessionTokenResp, err := stsClient.GetSessionToken(sessionTokenInput)
+	creds, identity, err := m.resolveSourceCredentials(ctx, name, mfa, map[string]bool{}, 0)
 	if err != nil {
-		err = checkErr(err)
+		// A bad MFA code entered by the user is a fatal condition, since
+		// retrying it unattended will keep failing the same way.
+		if mfa != "" {
+			err = makeFatal(err)
+		}
 		m.err = err
 		return err
 	}
 
-	m.credentials = sessionTokenResp.Credentials
-	m.sourceCredentials = sessionTokenResp.Credentials
+	m.credentials = creds
+	m.sourceCredentials = creds
 	m.sourceSession = session.New(&aws.Config{
 		Region: &profile.Region,
 		Credentials: credentials.NewStaticCredentials(
-			*m.credentials.AccessKeyId,
-			*m.credentials.SecretAccessKey,
-			*m.credentials.SessionToken,
+			*creds.AccessKeyId,
+			*creds.SecretAccessKey,
+			*creds.SessionToken,
 		),
 	})
 	m.role = name
 	m.sourceProfile = profile
 	m.sourceProfileName = name
 	m.sourceSTSClient = sts.New(m.sourceSession)
+
+	if identity == nil {
+		identity, err = m.sourceSTSClient.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+		if err != nil {
+			m.err = fmt.Errorf("verifying caller identity for profile %q: %w", name, err)
+			return m.err
+		}
+
+		if err := saveCachedCredentials(name, profile.MFASerial, "", profileFingerprint(profile), creds, &cachedIdentity{
+			Account: *identity.Account,
+			Arn:     *identity.Arn,
+			UserID:  *identity.UserId,
+		}); err != nil {
+			log.Printf("caching session for profile %q: %v", name, err)
+		}
+	}
+	m.sourceIdentity = identity
+
+	if profile.AccountID != "" && profile.AccountID != *identity.Account {
+		m.err = makeFatal(fmt.Errorf("profile %q declares account_id %q but resolved credentials belong to account %q", name, profile.AccountID, *identity.Account))
+		return m.err
+	}
+
+	return nil
+}
+
+// WhoAmI returns the cached caller identity of the current source profile,
+// as last observed by sts:GetCallerIdentity in SetSourceProfile.
+func (m *CredentialsExpirationManager) WhoAmI() (*sts.GetCallerIdentityOutput, error) {
+	if m.sourceIdentity == nil {
+		return nil, errNoIdentity
+	}
+	return m.sourceIdentity, nil
+}
+
+// verifyAccountMatch fails fast if profile declares an expected account
+// (directly via account_id, or implicitly via an mfa_serial that encodes
+// one) that doesn't match the source profile's verified identity. This
+// guards against a user editing ~/.aws/credentials under limes and silently
+// getting a session for the wrong AWS account.
+func (m *CredentialsExpirationManager) verifyAccountMatch(profile Profile) error {
+	if m.sourceIdentity == nil {
+		return nil
+	}
+
+	expected := profile.AccountID
+	if expected == "" {
+		expected = accountFromARN(profile.MFASerial)
+	}
+	if expected == "" {
+		return nil
+	}
+
+	if expected != *m.sourceIdentity.Account {
+		return fmt.Errorf("profile %q expects account %q but source profile %q resolved to account %q", profile.RoleARN, expected, m.sourceProfileName, *m.sourceIdentity.Account)
+	}
 	return nil
 }
 
@@ -178,15 +244,30 @@ func (m *CredentialsExpirationManager) Role() string {
 	return m.role
 }
 
-// Refresher starts a Go routine and refreshes the credentials
-func (m *CredentialsExpirationManager) Refresher() {
+// refreshAttemptTimeout bounds a single refreshCredentials call, so a stuck
+// upstream STS/MFA/SSO call can't hold m.lock (and the process-wide Refresher
+// loop) forever; Refresher just logs the timeout and retries on its next
+// tick.
+const refreshAttemptTimeout = 30 * time.Second
+
+// Refresher starts a Go routine and refreshes the credentials. It runs until
+// ctx is cancelled, so the caller (Stop) can shut it down gracefully instead
+// of leaking it for the life of the process.
+func (m *CredentialsExpirationManager) Refresher(ctx context.Context) {
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-time.After(10 * time.Second):
 			if m.err != nil {
 				continue
 			}
-			m.refreshCredentials()
+			attemptCtx, cancel := context.WithTimeout(ctx, refreshAttemptTimeout)
+			err := m.refreshCredentials(attemptCtx)
+			cancel()
+			if err != nil {
+				log.Printf("refreshing credentials: %v", err)
+			}
 		}
 	}
 }
@@ -194,25 +275,41 @@ func (m *CredentialsExpirationManager) Refresher() {
 // AssumeRole changes (assumes) the role `name`. An optional MFA can be passed
 // to the function, if set to "" the MFA is ignored
 func (m *CredentialsExpirationManager) AssumeRole(name, MFA string) error {
+	return m.AssumeRoleWithContext(context.Background(), name, MFA)
+}
+
+// AssumeRoleWithContext is AssumeRole with a caller-supplied context, so a
+// stuck upstream STS call can be cancelled by the caller.
+func (m *CredentialsExpirationManager) AssumeRoleWithContext(ctx context.Context, name, MFA string) error {
 	profile, ok := m.config.profiles[name]
 	if !ok {
 		return errUnknownProfile
 	}
 
 	if profile.SourceProfile != m.sourceProfileName || m.sourceCredentialsExpired() {
-		err := m.SetSourceProfile(profile.SourceProfile, MFA)
+		err := m.SetSourceProfileWithContext(ctx, profile.SourceProfile, MFA)
 		if err != nil {
 			return err
 		}
 	}
 
+	if err := m.verifyAccountMatch(profile); err != nil {
+		return makeFatal(err)
+	}
+
 	fmt.Println("Assuming: ", name)
-	return m.AssumeRoleARN(name, profile.RoleARN, profile.MFASerial, MFA)
+	return m.AssumeRoleARNWithContext(ctx, name, profile.RoleARN, profile.MFASerial, MFA, profile.DurationSeconds)
 }
 
 // RetrieveRole will assume and fetch temporary credentials, but does not update
 // the role and credentials stored by the manager.
 func (m *CredentialsExpirationManager) RetrieveRole(name, MFA string) (*sts.Credentials, error) {
+	return m.RetrieveRoleWithContext(context.Background(), name, MFA)
+}
+
+// RetrieveRoleWithContext is RetrieveRole with a caller-supplied context, so
+// a stuck upstream STS call can be cancelled by the caller.
+func (m *CredentialsExpirationManager) RetrieveRoleWithContext(ctx context.Context, name, MFA string) (*sts.Credentials, error) {
 	if m.err != nil {
 		return nil, m.err
 	}
@@ -223,23 +320,45 @@ func (m *CredentialsExpirationManager) RetrieveRole(name, MFA string) (*sts.Cred
 	}
 
 	if profile.SourceProfile != m.sourceProfileName || m.sourceCredentialsExpired() {
-		err := m.SetSourceProfile(profile.SourceProfile, MFA)
+		err := m.SetSourceProfileWithContext(ctx, profile.SourceProfile, MFA)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return m.RetrieveRoleARN(profile.RoleARN, profile.MFASerial, MFA)
+	if err := m.verifyAccountMatch(profile); err != nil {
+		return nil, makeFatal(err)
+	}
+
+	return m.RetrieveRoleARNWithContext(ctx, profile.RoleARN, profile.MFASerial, MFA, profile.DurationSeconds)
 }
 
 // RetrieveRoleARN assumes and fetch temporary credentials based on the RoleArn
-func (m *CredentialsExpirationManager) RetrieveRoleARN(RoleARN, MFASerial, MFA string) (*sts.Credentials, error) {
+func (m *CredentialsExpirationManager) RetrieveRoleARN(RoleARN, MFASerial, MFA string, durationSeconds int64) (*sts.Credentials, error) {
+	return m.RetrieveRoleARNWithContext(context.Background(), RoleARN, MFASerial, MFA, durationSeconds)
+}
+
+// RetrieveRoleARNWithContext is RetrieveRoleARN with a caller-supplied
+// context, so a stuck upstream STS call can be cancelled by the caller.
+// durationSeconds overrides the AWS default AssumeRole session length (1h)
+// when non-zero, up to whatever the target role's trust policy permits.
+func (m *CredentialsExpirationManager) RetrieveRoleARNWithContext(ctx context.Context, RoleARN, MFASerial, MFA string, durationSeconds int64) (*sts.Credentials, error) {
+	return m.retrieveRoleARNWithContext(ctx, RoleARN, MFASerial, MFA, durationSeconds, false)
+}
+
+// retrieveRoleARNWithContext is RetrieveRoleARNWithContext's implementation.
+// bypassCache skips the on-disk session cache read: refreshCredentials uses
+// this for its proactive refresh (triggered 10 minutes before expiration),
+// since the cache was written by the very credential it's trying to get
+// ahead of and would otherwise just hand that same near-expiry credential
+// straight back, silently shrinking the 10-minute buffer down to cacheSkew.
+func (m *CredentialsExpirationManager) retrieveRoleARNWithContext(ctx context.Context, RoleARN, MFASerial, MFA string, durationSeconds int64, bypassCache bool) (*sts.Credentials, error) {
 	if m.err != nil {
 		return nil, m.err
 	}
 
 	if m.sourceCredentialsExpired() {
-		err := m.SetSourceProfile(m.sourceProfileName, MFA)
+		err := m.SetSourceProfileWithContext(ctx, m.sourceProfileName, MFA)
 		if err != nil {
 			return nil, err
 		}
@@ -250,39 +369,51 @@ func (m *CredentialsExpirationManager) RetrieveRoleARN(RoleARN, MFASerial, MFA s
 		return m.sourceCredentials, nil
 	}
 
-	if MFASerial != "" && MFA == "" {
-		return nil, errMFANeeded
+	sourceAccountID := ""
+	if m.sourceIdentity != nil {
+		sourceAccountID = *m.sourceIdentity.Account
 	}
 
-	assumeRoleInput := &sts.AssumeRoleInput{
-		RoleArn:         &RoleARN,
-		RoleSessionName: &m.sourceProfile.RoleSessionName,
+	cacheKey := roleARNCacheKey(RoleARN)
+	if !bypassCache {
+		if creds, _, err := loadCachedCredentials(cacheKey, MFASerial, sourceAccountID, ""); err == nil {
+			log.Printf("Using cached assumed-role credentials for %v", RoleARN)
+			return creds, nil
+		}
 	}
 
-	if MFASerial != "" {
-		assumeRoleInput.SerialNumber = &MFASerial
+	if MFASerial != "" && MFA == "" {
+		return nil, errMFANeeded
 	}
 
-	if MFA != "" {
-		assumeRoleInput.TokenCode = &MFA
-	}
+	assumeRoleInput := buildAssumeRoleInput(RoleARN, m.sourceProfile.RoleSessionName, MFASerial, MFA, durationSeconds)
 
-	resp, err := m.sourceSTSClient.AssumeRole(assumeRoleInput)
+	resp, err := m.sourceSTSClient.AssumeRoleWithContext(ctx, assumeRoleInput)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := saveCachedCredentials(cacheKey, MFASerial, sourceAccountID, "", resp.Credentials, nil); err != nil {
+		log.Printf("caching assumed-role credentials for %v: %v", RoleARN, err)
+	}
+
 	return resp.Credentials, nil
 }
 
 // AssumeRoleARN assumes the role specified by RoleARN and will store it as
 // with the name specified.
-func (m *CredentialsExpirationManager) AssumeRoleARN(name, RoleARN, MFASerial, MFA string) error {
+func (m *CredentialsExpirationManager) AssumeRoleARN(name, RoleARN, MFASerial, MFA string, durationSeconds int64) error {
+	return m.AssumeRoleARNWithContext(context.Background(), name, RoleARN, MFASerial, MFA, durationSeconds)
+}
+
+// AssumeRoleARNWithContext is AssumeRoleARN with a caller-supplied context,
+// so a stuck upstream STS call can be cancelled by the caller.
+func (m *CredentialsExpirationManager) AssumeRoleARNWithContext(ctx context.Context, name, RoleARN, MFASerial, MFA string, durationSeconds int64) error {
 	if m.err != nil {
 		return m.err
 	}
 
-	creds, err := m.RetrieveRoleARN(RoleARN, MFASerial, MFA)
+	creds, err := m.RetrieveRoleARNWithContext(ctx, RoleARN, MFASerial, MFA, durationSeconds)
 	if err != nil {
 		return err
 	}
@@ -295,19 +426,44 @@ func (m *CredentialsExpirationManager) AssumeRoleARN(name, RoleARN, MFASerial, M
 // with the credentials
 func (m *CredentialsExpirationManager) setCredentials(newCreds *sts.Credentials, role string) {
 	m.lock.Lock()
-	defer m.lock.Unlock()
-
 	m.credentials = newCreds
 	m.role = role
+	profile, hasSharedTarget := m.config.profiles[role]
+	hasSharedTarget = hasSharedTarget && profile.SharedCredentialsTarget != ""
+	m.lock.Unlock()
+
+	// Writing ~/.aws/credentials is a filesystem operation (potentially a
+	// slow or stuck NFS-mounted home dir) and must not be done while holding
+	// m.lock, since that would block GetCredentialsWithContext's readers too
+	// - defeating the whole point of chunk0-4's cancellable, non-blocking API.
+	if hasSharedTarget {
+		if err := writeSharedCredentialsSection(sharedCredentialsFilePath(), profile.SharedCredentialsTarget, newCreds); err != nil {
+			log.Printf("writing shared credentials for profile %q: %v", profile.SharedCredentialsTarget, err)
+		}
+	}
 }
 
 // GetCredentials returns the current saved credentials. The returned credentials
 // are copied before they are returned.
 func (m *CredentialsExpirationManager) GetCredentials() (*sts.Credentials, error) {
+	return m.GetCredentialsWithContext(context.Background())
+}
+
+// GetCredentialsWithContext is GetCredentials with a caller-supplied
+// context. GetCredentials never itself calls out to STS, but the context is
+// accepted for API symmetry with the rest of CredentialsManager and so
+// callers can thread cancellation through uniformly.
+func (m *CredentialsExpirationManager) GetCredentialsWithContext(ctx context.Context) (*sts.Credentials, error) {
 	if m.err != nil {
 		return nil, m.err
 	}
 
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
@@ -319,16 +475,26 @@ func (m *CredentialsExpirationManager) GetCredentials() (*sts.Credentials, error
 	}, nil
 }
 
+// sourceCredentialsExpired reports whether m.sourceCredentials is at or past
+// its expiration (minus cacheSkew). It must not rely on
+// m.sourceSTSClient.Config.Credentials.IsExpired(): every source-credential
+// path (static keys, web identity, SSO, credential_process, EC2 metadata,
+// chained roles) wraps its result in credentials.NewStaticCredentials,
+// whose IsExpired() is hardcoded false regardless of the real Expiration
+// the STS/OIDC/SSO call returned.
 func (m *CredentialsExpirationManager) sourceCredentialsExpired() bool {
-	return m.sourceSTSClient.Config.Credentials.IsExpired()
+	if m.sourceCredentials == nil || m.sourceCredentials.Expiration == nil {
+		return true
+	}
+	return time.Now().Add(cacheSkew).After(*m.sourceCredentials.Expiration)
 }
 
-func (m *CredentialsExpirationManager) refreshCredentials() error {
+func (m *CredentialsExpirationManager) refreshCredentials(ctx context.Context) error {
 	if m.sourceSTSClient == nil {
 		return errors.New("No STS client set for refreshing credentials")
 	}
 
-	creds, err := m.GetCredentials()
+	creds, err := m.GetCredentialsWithContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -344,5 +510,28 @@ func (m *CredentialsExpirationManager) refreshCredentials() error {
 	}
 
 	fmt.Println("====> refreshing credentials")
-	return m.AssumeRole(m.role, "")
+
+	profile, ok := m.config.profiles[m.role]
+	if !ok {
+		return errUnknownProfile
+	}
+
+	if profile.SourceProfile != m.sourceProfileName || m.sourceCredentialsExpired() {
+		if err := m.SetSourceProfileWithContext(ctx, profile.SourceProfile, ""); err != nil {
+			return err
+		}
+	}
+
+	if err := m.verifyAccountMatch(profile); err != nil {
+		return makeFatal(err)
+	}
+
+	// bypassCache: see retrieveRoleARNWithContext's doc comment.
+	newCreds, err := m.retrieveRoleARNWithContext(ctx, profile.RoleARN, profile.MFASerial, "", profile.DurationSeconds, true)
+	if err != nil {
+		return err
+	}
+
+	m.setCredentials(newCreds, m.role)
+	return nil
 }
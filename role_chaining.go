@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// maxRoleChainDepth bounds how deep a source_profile -> source_profile chain
+// may go, so a misconfigured cycle fails fast instead of recursing forever.
+const maxRoleChainDepth = 10
+
+// resolveSourceCredentials resolves the credentials for profile name,
+// recursively following source_profile when name is itself an assumed-role
+// profile rather than a base credentials profile (role chaining). visited
+// guards against cycles and depth against pathologically long chains.
+//
+// It checks the on-disk session cache before doing any network or STS work,
+// keyed on profileFingerprint(profile) so an in-place profile edit (key
+// rotation, repointing credential_process/sso_start_url, a new role_arn)
+// invalidates the old entry instead of serving its stale identity. On a hit
+// it returns the cached caller identity alongside the credentials (the
+// base-profile case), so the caller can skip a redundant
+// sts:GetCallerIdentity call.
+func (m *CredentialsExpirationManager) resolveSourceCredentials(ctx context.Context, name, mfa string, visited map[string]bool, depth int) (*sts.Credentials, *sts.GetCallerIdentityOutput, error) {
+	if depth > maxRoleChainDepth {
+		return nil, nil, fmt.Errorf("source_profile chain exceeds max depth %d at %q", maxRoleChainDepth, name)
+	}
+	if visited[name] {
+		return nil, nil, fmt.Errorf("source_profile chain has a cycle at %q", name)
+	}
+	visited[name] = true
+
+	profile, ok := m.config.profiles[name]
+	if !ok {
+		return nil, nil, errUnknownProfile
+	}
+
+	// Validate account_id against the role_arn account segment before
+	// consulting the cache: a cache hit must not let a misconfigured (or
+	// since-edited) profile skip the drift check chunk0-3 added.
+	if profile.AccountID != "" && profile.RoleARN != "" {
+		if actual := accountFromARN(profile.RoleARN); actual != "" && actual != profile.AccountID {
+			return nil, nil, fmt.Errorf("profile %q declares account_id %q but role_arn %q is in account %q", name, profile.AccountID, profile.RoleARN, actual)
+		}
+	}
+
+	if cached, cachedIdent, err := loadCachedCredentials(name, profile.MFASerial, "", profileFingerprint(profile)); err == nil {
+		log.Printf("Using cached session for profile: %v", name)
+		var identity *sts.GetCallerIdentityOutput
+		if cachedIdent != nil {
+			identity = &sts.GetCallerIdentityOutput{
+				Account: aws.String(cachedIdent.Account),
+				Arn:     aws.String(cachedIdent.Arn),
+				UserId:  aws.String(cachedIdent.UserID),
+			}
+		}
+		return cached, identity, nil
+	}
+
+	if profile.RoleARN != "" && profile.SourceProfile != "" {
+		return m.resolveChainedRoleCredentials(ctx, name, profile, mfa, visited, depth)
+	}
+
+	provider, err := sourceProviderForProfile(profile, mfa)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	creds, err := provider.Retrieve(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return creds, nil, nil
+}
+
+// resolveChainedRoleCredentials assumes profile's role using its own
+// source_profile chain, rather than static/SSO/etc. credentials directly.
+// This is the path for a profile whose source_profile points at another
+// *assumed-role* profile instead of a base credentials profile.
+func (m *CredentialsExpirationManager) resolveChainedRoleCredentials(ctx context.Context, name string, profile Profile, mfa string, visited map[string]bool, depth int) (*sts.Credentials, *sts.GetCallerIdentityOutput, error) {
+	if profile.MFASerial != "" && mfa == "" {
+		return nil, nil, errMFANeeded
+	}
+
+	// account_id vs role_arn is validated by resolveSourceCredentials before
+	// it ever calls us, including on the cache-hit path.
+
+	parentCreds, _, err := m.resolveSourceCredentials(ctx, profile.SourceProfile, mfa, visited, depth+1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolving source_profile chain at %q: %w", name, err)
+	}
+
+	parentProfile := m.config.profiles[profile.SourceProfile]
+
+	parentSession := session.New(&aws.Config{
+		Region: &parentProfile.Region,
+		Credentials: credentials.NewStaticCredentials(
+			*parentCreds.AccessKeyId,
+			*parentCreds.SecretAccessKey,
+			*parentCreds.SessionToken,
+		),
+	})
+	stsClient := sts.New(parentSession)
+
+	duration := profile.SourceDurationSeconds
+	if duration == 0 {
+		duration = 3600
+	}
+
+	input := buildAssumeRoleInput(profile.RoleARN, profile.RoleSessionName, profile.MFASerial, mfa, duration)
+
+	resp, err := stsClient.AssumeRoleWithContext(ctx, input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Entry-point (depth 0) calls are for the profile SetSourceProfile was
+	// actually asked for; it re-caches this same key once it has the
+	// verified caller identity too, so skip the redundant write here.
+	if depth > 0 {
+		if err := saveCachedCredentials(name, profile.MFASerial, "", profileFingerprint(profile), resp.Credentials, nil); err != nil {
+			log.Printf("caching chained source profile %q: %v", name, err)
+		}
+	}
+
+	return resp.Credentials, nil, nil
+}
+
+// buildAssumeRoleInput builds an sts.AssumeRoleInput, applying the repo-wide
+// default session name and treating a zero duration as "use the AWS
+// default".
+func buildAssumeRoleInput(roleARN, roleSessionName, mfaSerial, mfa string, durationSeconds int64) *sts.AssumeRoleInput {
+	sessionName := roleSessionName
+	if sessionName == "" {
+		sessionName = "limes"
+	}
+
+	input := &sts.AssumeRoleInput{
+		RoleArn:         aws.String(roleARN),
+		RoleSessionName: aws.String(sessionName),
+	}
+	if durationSeconds != 0 {
+		input.DurationSeconds = aws.Int64(durationSeconds)
+	}
+	if mfaSerial != "" {
+		input.SerialNumber = aws.String(mfaSerial)
+	}
+	if mfa != "" {
+		input.TokenCode = aws.String(mfa)
+	}
+	return input
+}
+
+// accountFromARN extracts the account id from an ARN, e.g.
+// "arn:aws:iam::123456789012:mfa/jdoe" -> "123456789012". Returns "" if arn
+// isn't an ARN in the expected shape.
+func accountFromARN(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 5 {
+		return ""
+	}
+	return parts[4]
+}
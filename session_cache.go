@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// cacheSkew is subtracted from a cached entry's expiration when deciding
+// whether it's still usable, so we don't hand out credentials that expire
+// moments after being read from disk.
+const cacheSkew = 2 * time.Minute
+
+// cachedIdentity is the subset of sts:GetCallerIdentity persisted alongside
+// cached credentials, so a cache written under one AWS account is never
+// reused for a profile now resolving to another.
+type cachedIdentity struct {
+	Account string
+	Arn     string
+	UserID  string
+}
+
+// sessionCacheEntry is the on-disk representation of a cached session or
+// assumed-role credential set, stored under
+// $XDG_CACHE_HOME/limes/sessions/<key>.json.
+type sessionCacheEntry struct {
+	MFASerial         string
+	SourceAccountID   string
+	ConfigFingerprint string
+	Identity          *cachedIdentity
+	AccessKeyID       string
+	SecretAccessKey   string
+	SessionToken      string
+	Expiration        time.Time
+}
+
+// sessionCacheDir returns the directory limes caches session and
+// assumed-role credentials in, creating it (mode 0700) if needed.
+func sessionCacheDir() (string, error) {
+	base := os.Getenv("XDG_CACHE_HOME")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		base = filepath.Join(home, ".cache")
+	}
+
+	dir := filepath.Join(base, "limes", "sessions")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// sessionCachePath returns the cache file path for key, a filesystem-safe
+// identifier such as a profile name or a sanitized role ARN.
+func sessionCachePath(key string) (string, error) {
+	dir, err := sessionCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, key+".json"), nil
+}
+
+// roleARNCacheKey turns a role ARN into a filesystem-safe cache key.
+func roleARNCacheKey(roleARN string) string {
+	return strings.NewReplacer(":", "_", "/", "_").Replace(roleARN)
+}
+
+// profileFingerprint hashes the fields of profile that determine which
+// identity it resolves to. It's stored alongside a cached session so that
+// editing a profile in place - rotating aws_access_key_id, repointing
+// credential_process/sso_start_url, or changing role_arn/source_profile -
+// invalidates the old cache entry instead of silently going on serving the
+// pre-edit identity until it happens to expire.
+func profileFingerprint(profile Profile) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s",
+		profile.AwsAccessKeyID,
+		profile.CredentialProcess,
+		profile.SSOStartURL,
+		profile.CredentialSource,
+		profile.WebIdentityTokenFile,
+		profile.WebIdentityTokenCommand,
+		profile.RoleARN,
+		profile.SourceProfile,
+	)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadCachedCredentials loads and validates a cached entry for key. It
+// returns an error (and no credentials) if the file doesn't exist, the MFA
+// serial, source account, or config fingerprint don't match what the caller
+// expects, or the credentials are at or past expiration (minus cacheSkew).
+// expectConfigFingerprint ties the entry to the profile's credential-source
+// fields (see profileFingerprint) so editing a profile in place - rotating
+// keys, repointing credential_process/sso_start_url, changing role_arn - is
+// enough to invalidate a cache that would otherwise outlive the edit.
+// Passing "" skips that check, for the role-ARN cache which isn't keyed by
+// a single profile.
+func loadCachedCredentials(key, mfaSerial, expectSourceAccountID, expectConfigFingerprint string) (*sts.Credentials, *cachedIdentity, error) {
+	path, err := sessionCachePath(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entry sessionCacheEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return nil, nil, fmt.Errorf("parsing session cache %q: %w", path, err)
+	}
+
+	if entry.MFASerial != mfaSerial {
+		return nil, nil, fmt.Errorf("cached entry %q was saved for a different MFA serial", key)
+	}
+	if expectSourceAccountID != "" && entry.SourceAccountID != expectSourceAccountID {
+		return nil, nil, fmt.Errorf("cached entry %q was saved for a different source account", key)
+	}
+	if expectConfigFingerprint != "" && entry.ConfigFingerprint != expectConfigFingerprint {
+		return nil, nil, fmt.Errorf("cached entry %q was saved for a different profile configuration", key)
+	}
+	if time.Now().Add(cacheSkew).After(entry.Expiration) {
+		return nil, nil, fmt.Errorf("cached entry %q has expired", key)
+	}
+
+	return &sts.Credentials{
+		AccessKeyId:     aws.String(entry.AccessKeyID),
+		SecretAccessKey: aws.String(entry.SecretAccessKey),
+		SessionToken:    aws.String(entry.SessionToken),
+		Expiration:      aws.Time(entry.Expiration),
+	}, entry.Identity, nil
+}
+
+// saveCachedCredentials persists creds (and, for a source profile, its
+// verified identity) to the cache file for key. Files are written via
+// temp-file + rename so a concurrent reader never observes a partial write,
+// and with mode 0600 since the file contains live AWS credentials.
+// configFingerprint is checked by loadCachedCredentials on the next read;
+// pass "" for caches (like the role-ARN cache) not tied to one profile.
+func saveCachedCredentials(key, mfaSerial, sourceAccountID, configFingerprint string, creds *sts.Credentials, identity *cachedIdentity) error {
+	path, err := sessionCachePath(key)
+	if err != nil {
+		return err
+	}
+
+	entry := sessionCacheEntry{
+		MFASerial:         mfaSerial,
+		SourceAccountID:   sourceAccountID,
+		ConfigFingerprint: configFingerprint,
+		Identity:          identity,
+		AccessKeyID:       *creds.AccessKeyId,
+		SecretAccessKey:   *creds.SecretAccessKey,
+		SessionToken:      *creds.SessionToken,
+		Expiration:        *creds.Expiration,
+	}
+
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
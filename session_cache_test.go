@@ -0,0 +1,152 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+func TestSaveAndLoadCachedCredentialsRoundTrip(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	creds := &sts.Credentials{
+		AccessKeyId:     aws.String("AKIAEXAMPLE"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}
+	identity := &cachedIdentity{
+		Account: "123456789012",
+		Arn:     "arn:aws:sts::123456789012:assumed-role/foo/bar",
+		UserID:  "AROAEXAMPLE:bar",
+	}
+
+	if err := saveCachedCredentials("profile-a", "mfa-serial", "123456789012", "fingerprint-a", creds, identity); err != nil {
+		t.Fatalf("saveCachedCredentials: %v", err)
+	}
+
+	got, gotIdentity, err := loadCachedCredentials("profile-a", "mfa-serial", "123456789012", "fingerprint-a")
+	if err != nil {
+		t.Fatalf("loadCachedCredentials: %v", err)
+	}
+	if *got.AccessKeyId != *creds.AccessKeyId || *got.SecretAccessKey != *creds.SecretAccessKey || *got.SessionToken != *creds.SessionToken {
+		t.Fatalf("round-tripped credentials = %+v, want %+v", got, creds)
+	}
+	if gotIdentity == nil || *gotIdentity != *identity {
+		t.Fatalf("round-tripped identity = %+v, want %+v", gotIdentity, identity)
+	}
+}
+
+func TestLoadCachedCredentialsRejectsMFASerialMismatch(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	creds := &sts.Credentials{
+		AccessKeyId:     aws.String("AKIAEXAMPLE"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}
+	if err := saveCachedCredentials("profile-b", "mfa-serial", "", "", creds, nil); err != nil {
+		t.Fatalf("saveCachedCredentials: %v", err)
+	}
+
+	if _, _, err := loadCachedCredentials("profile-b", "different-serial", "", ""); err == nil {
+		t.Fatal("expected error for mismatched MFA serial, got nil")
+	}
+}
+
+func TestLoadCachedCredentialsRejectsSourceAccountMismatch(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	creds := &sts.Credentials{
+		AccessKeyId:     aws.String("AKIAEXAMPLE"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}
+	if err := saveCachedCredentials("profile-c", "", "111111111111", "", creds, nil); err != nil {
+		t.Fatalf("saveCachedCredentials: %v", err)
+	}
+
+	if _, _, err := loadCachedCredentials("profile-c", "", "222222222222", ""); err == nil {
+		t.Fatal("expected error for mismatched source account, got nil")
+	}
+}
+
+func TestLoadCachedCredentialsRejectsConfigFingerprintMismatch(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	creds := &sts.Credentials{
+		AccessKeyId:     aws.String("AKIAEXAMPLE"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}
+	if err := saveCachedCredentials("profile-e", "", "", "fingerprint-before-edit", creds, nil); err != nil {
+		t.Fatalf("saveCachedCredentials: %v", err)
+	}
+
+	if _, _, err := loadCachedCredentials("profile-e", "", "", "fingerprint-after-edit"); err == nil {
+		t.Fatal("expected error for mismatched config fingerprint, got nil")
+	}
+
+	if _, _, err := loadCachedCredentials("profile-e", "", "", "fingerprint-before-edit"); err != nil {
+		t.Fatalf("loadCachedCredentials with matching fingerprint: %v", err)
+	}
+}
+
+func TestLoadCachedCredentialsRejectsExpiredEntry(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	creds := &sts.Credentials{
+		AccessKeyId:     aws.String("AKIAEXAMPLE"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(cacheSkew / 2)),
+	}
+	if err := saveCachedCredentials("profile-d", "", "", "", creds, nil); err != nil {
+		t.Fatalf("saveCachedCredentials: %v", err)
+	}
+
+	if _, _, err := loadCachedCredentials("profile-d", "", "", ""); err == nil {
+		t.Fatal("expected error for entry within cacheSkew of expiring, got nil")
+	}
+}
+
+func TestProfileFingerprintChangesWithCredentialSource(t *testing.T) {
+	base := Profile{AwsAccessKeyID: "AKIAORIGINAL"}
+	rotatedKey := Profile{AwsAccessKeyID: "AKIAROTATED"}
+	differentProcess := Profile{CredentialProcess: "get-creds.sh"}
+	differentSSO := Profile{SSOStartURL: "https://example.awsapps.com/start"}
+
+	fingerprints := []string{
+		profileFingerprint(base),
+		profileFingerprint(rotatedKey),
+		profileFingerprint(differentProcess),
+		profileFingerprint(differentSSO),
+	}
+	for i := range fingerprints {
+		for j := range fingerprints {
+			if i == j {
+				continue
+			}
+			if fingerprints[i] == fingerprints[j] {
+				t.Fatalf("profileFingerprint collided for distinct profiles %d and %d", i, j)
+			}
+		}
+	}
+
+	if profileFingerprint(base) != profileFingerprint(base) {
+		t.Fatal("profileFingerprint is not deterministic for an unchanged profile")
+	}
+}
+
+func TestRoleARNCacheKeySanitizesARN(t *testing.T) {
+	got := roleARNCacheKey("arn:aws:iam::123456789012:role/foo")
+	want := "arn_aws_iam__123456789012_role_foo"
+	if got != want {
+		t.Fatalf("roleARNCacheKey() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// sharedCredentialsMarker returns the start/end comment lines that bound the
+// section limes owns for targetProfile in the shared credentials file, so
+// it only ever touches its own section and leaves user-managed profiles
+// alone.
+func sharedCredentialsMarker(targetProfile string) (start, end string) {
+	return fmt.Sprintf("# BEGIN limes-managed profile: %s", targetProfile),
+		fmt.Sprintf("# END limes-managed profile: %s", targetProfile)
+}
+
+// sharedCredentialsFilePath returns the shared credentials file limes should
+// write refreshed credentials into, honoring AWS_SHARED_CREDENTIALS_FILE.
+func sharedCredentialsFilePath() string {
+	if path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); path != "" {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".aws", "credentials")
+	}
+	return filepath.Join(home, ".aws", "credentials")
+}
+
+// writeSharedCredentialsSection atomically rewrites the
+// limes-managed [targetProfile] section of the shared credentials file at
+// path with creds, leaving the rest of the file untouched. This lets tools
+// that don't honor the EC2 metadata shim (Terraform providers pinning
+// shared_credentials_file, third-party CLIs, IDE plugins) transparently
+// pick up limes-managed credentials.
+func writeSharedCredentialsSection(path, targetProfile string, creds *sts.Credentials) error {
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var lines []string
+	if len(existing) > 0 {
+		lines = strings.Split(strings.TrimRight(string(existing), "\n"), "\n")
+	}
+
+	start, end := sharedCredentialsMarker(targetProfile)
+	section := []string{
+		start,
+		fmt.Sprintf("[%s]", targetProfile),
+		fmt.Sprintf("aws_access_key_id = %s", *creds.AccessKeyId),
+		fmt.Sprintf("aws_secret_access_key = %s", *creds.SecretAccessKey),
+		fmt.Sprintf("aws_session_token = %s", *creds.SessionToken),
+		fmt.Sprintf("# expires %s", creds.Expiration.Format(time.RFC3339)),
+		end,
+	}
+
+	lines = replaceMarkedSection(lines, start, end, section)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp := path + ".limes-tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// replaceMarkedSection returns lines with the block delimited by start/end
+// (inclusive) replaced by replacement, or replacement appended at the end
+// if no such block exists yet.
+func replaceMarkedSection(lines []string, start, end string, replacement []string) []string {
+	startIdx, endIdx := -1, -1
+	for i, line := range lines {
+		if strings.TrimSpace(line) == start {
+			startIdx = i
+			continue
+		}
+		if startIdx != -1 && strings.TrimSpace(line) == end {
+			endIdx = i
+			break
+		}
+	}
+
+	if startIdx == -1 || endIdx == -1 {
+		if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+			lines = append(lines, "")
+		}
+		return append(lines, replacement...)
+	}
+
+	out := append([]string{}, lines[:startIdx]...)
+	out = append(out, replacement...)
+	out = append(out, lines[endIdx+1:]...)
+	return out
+}
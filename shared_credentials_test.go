@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+func TestReplaceMarkedSectionAppendsWhenMissing(t *testing.T) {
+	lines := []string{"[default]", "aws_access_key_id = AKIA"}
+	replacement := []string{"# BEGIN limes-managed profile: work", "[work]", "# END limes-managed profile: work"}
+
+	got := replaceMarkedSection(lines, "# BEGIN limes-managed profile: work", "# END limes-managed profile: work", replacement)
+
+	want := append(append([]string{}, lines...), "", "# BEGIN limes-managed profile: work", "[work]", "# END limes-managed profile: work")
+	if !stringSlicesEqual(got, want) {
+		t.Fatalf("replaceMarkedSection() = %v, want %v", got, want)
+	}
+}
+
+func TestReplaceMarkedSectionReplacesExistingBlockInPlace(t *testing.T) {
+	start, end := "# BEGIN limes-managed profile: work", "# END limes-managed profile: work"
+	lines := []string{
+		"[default]",
+		"aws_access_key_id = AKIA",
+		start,
+		"[work]",
+		"aws_access_key_id = OLD",
+		end,
+		"[other]",
+		"aws_access_key_id = KEEPME",
+	}
+	replacement := []string{start, "[work]", "aws_access_key_id = NEW", end}
+
+	got := replaceMarkedSection(lines, start, end, replacement)
+
+	want := []string{
+		"[default]",
+		"aws_access_key_id = AKIA",
+		start,
+		"[work]",
+		"aws_access_key_id = NEW",
+		end,
+		"[other]",
+		"aws_access_key_id = KEEPME",
+	}
+	if !stringSlicesEqual(got, want) {
+		t.Fatalf("replaceMarkedSection() = %v, want %v", got, want)
+	}
+}
+
+func TestReplaceMarkedSectionLeavesOtherSectionsUntouched(t *testing.T) {
+	start, end := "# BEGIN limes-managed profile: work", "# END limes-managed profile: work"
+	otherStart, otherEnd := "# BEGIN limes-managed profile: other", "# END limes-managed profile: other"
+	lines := []string{
+		otherStart,
+		"[other]",
+		otherEnd,
+		start,
+		"[work]",
+		end,
+	}
+	replacement := []string{start, "[work]", "aws_access_key_id = NEW", end}
+
+	got := replaceMarkedSection(lines, start, end, replacement)
+
+	want := []string{
+		otherStart,
+		"[other]",
+		otherEnd,
+		start,
+		"[work]",
+		"aws_access_key_id = NEW",
+		end,
+	}
+	if !stringSlicesEqual(got, want) {
+		t.Fatalf("replaceMarkedSection() = %v, want %v", got, want)
+	}
+}
+
+func TestSharedCredentialsMarkerIsStableForTargetProfile(t *testing.T) {
+	start, end := sharedCredentialsMarker("work")
+	if start != "# BEGIN limes-managed profile: work" {
+		t.Fatalf("start marker = %q", start)
+	}
+	if end != "# END limes-managed profile: work" {
+		t.Fatalf("end marker = %q", end)
+	}
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
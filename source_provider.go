@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sso"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// SourceProvider resolves the session credentials a source profile uses to
+// assume roles. Implementations wrap the various places AWS lets an identity
+// originate from: static keys in the shared config, a credential_process,
+// a cached AWS SSO token, EC2/ECS instance metadata, or an OIDC web identity
+// token.
+type SourceProvider interface {
+	Retrieve(ctx context.Context) (*sts.Credentials, error)
+}
+
+// sourceProviderForProfile picks the SourceProvider implementation for a
+// profile based on which of the mutually-exclusive shared-config keys are
+// present, mirroring the precedence the AWS CLI itself uses.
+func sourceProviderForProfile(profile Profile, mfa string) (SourceProvider, error) {
+	switch {
+	case profile.WebIdentityTokenFile != "" || profile.WebIdentityTokenCommand != "":
+		if profile.AwsAccessKeyID != "" {
+			return nil, errWebIdentityTokenSource
+		}
+		return &webIdentityProvider{profile: profile}, nil
+	case profile.CredentialProcess != "":
+		return &credentialProcessProvider{profile: profile}, nil
+	case profile.SSOStartURL != "":
+		return &ssoProvider{profile: profile}, nil
+	case profile.CredentialSource == "Ec2InstanceMetadata" || profile.CredentialSource == "EcsContainer":
+		return &ec2MetadataProvider{profile: profile}, nil
+	default:
+		if profile.MFASerial != "" && mfa == "" {
+			return nil, errMFANeeded
+		}
+		return &staticKeysProvider{profile: profile, mfa: mfa}, nil
+	}
+}
+
+// staticKeysProvider retrieves a session token for a profile's long-lived
+// IAM access keys, as limes has always done. This is the fallback provider
+// when no other credential source is configured on the profile.
+type staticKeysProvider struct {
+	profile Profile
+	mfa     string
+}
+
+func (p *staticKeysProvider) Retrieve(ctx context.Context) (*sts.Credentials, error) {
+	sess := session.New(&aws.Config{
+		Region: &p.profile.Region,
+		Credentials: credentials.NewStaticCredentials(
+			p.profile.AwsAccessKeyID,
+			p.profile.AwsSecretAccessKey,
+			p.profile.AwsSessionToken,
+		),
+	})
+	stsClient := sts.New(sess)
+
+	duration := p.profile.SourceDurationSeconds
+	if duration == 0 {
+		duration = 10 * 3600
+	}
+	sessionTokenInput := &sts.GetSessionTokenInput{
+		DurationSeconds: aws.Int64(duration),
+	}
+	if p.profile.MFASerial != "" {
+		sessionTokenInput.SerialNumber = aws.String(p.profile.MFASerial)
+	}
+	if p.mfa != "" {
+		sessionTokenInput.TokenCode = aws.String(p.mfa)
+	}
+
+	resp, err := stsClient.GetSessionTokenWithContext(ctx, sessionTokenInput)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Credentials, nil
+}
+
+// webIdentityProvider retrieves credentials via sts:AssumeRoleWithWebIdentity
+// instead of static-key GetSessionToken. This is the path used by profiles
+// running under Kubernetes service accounts (EKS IRSA) or CI OIDC providers
+// (e.g. GitHub Actions), where the token is short-lived and rotated by the
+// platform rather than by limes, so it is re-read on every call.
+type webIdentityProvider struct {
+	profile Profile
+}
+
+func (p *webIdentityProvider) Retrieve(ctx context.Context) (*sts.Credentials, error) {
+	token, err := readWebIdentityToken(p.profile.WebIdentityTokenFile, p.profile.WebIdentityTokenCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := session.New(&aws.Config{Region: &p.profile.Region})
+	stsClient := sts.New(sess)
+
+	sessionName := p.profile.RoleSessionName
+	if sessionName == "" {
+		sessionName = "limes"
+	}
+
+	resp, err := stsClient.AssumeRoleWithWebIdentityWithContext(ctx, &sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.profile.RoleARN),
+		RoleSessionName:  aws.String(sessionName),
+		WebIdentityToken: aws.String(token),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Credentials, nil
+}
+
+// readWebIdentityToken returns the current web identity token, either by
+// reading tokenFile or, if tokenCommand is set instead, by running it and
+// taking its stdout. OIDC tokens rotate frequently, so this must be re-read
+// on every call rather than cached on the manager.
+func readWebIdentityToken(tokenFile, tokenCommand string) (string, error) {
+	if tokenCommand != "" {
+		out, err := exec.Command("sh", "-c", tokenCommand).Output()
+		if err != nil {
+			return "", fmt.Errorf("running web identity token command %q: %w", tokenCommand, err)
+		}
+		token := strings.TrimSpace(string(out))
+		if token == "" {
+			return "", errWebIdentityTokenEmpty
+		}
+		return token, nil
+	}
+
+	raw, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("reading web identity token file %q: %w", tokenFile, err)
+	}
+
+	token := strings.TrimSpace(string(raw))
+	if token == "" {
+		return "", errWebIdentityTokenEmpty
+	}
+	return token, nil
+}
+
+// credentialProcessOutput is the JSON document a `credential_process`
+// command is expected to print on stdout.
+// https://docs.aws.amazon.com/cli/latest/userguide/cli-configure-role.html#cli-configure-role-credential-process
+type credentialProcessOutput struct {
+	Version         int
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      *time.Time
+}
+
+// credentialProcessProvider shells out to a profile's `credential_process`
+// command and parses the credentials it prints on stdout.
+type credentialProcessProvider struct {
+	profile Profile
+}
+
+func (p *credentialProcessProvider) Retrieve(ctx context.Context) (*sts.Credentials, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", p.profile.CredentialProcess)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("running credential_process %q: %w", p.profile.CredentialProcess, err)
+	}
+	if len(strings.TrimSpace(string(out))) == 0 {
+		return nil, errCredentialProcessEmpty
+	}
+
+	var parsed credentialProcessOutput
+	if err := json.Unmarshal(out, &parsed); err != nil {
+		return nil, fmt.Errorf("parsing credential_process output: %w", err)
+	}
+
+	creds := &sts.Credentials{
+		AccessKeyId:     aws.String(parsed.AccessKeyID),
+		SecretAccessKey: aws.String(parsed.SecretAccessKey),
+		SessionToken:    aws.String(parsed.SessionToken),
+	}
+	if parsed.Expiration != nil {
+		creds.Expiration = parsed.Expiration
+	} else {
+		creds.Expiration = aws.Time(time.Now().Add(1 * time.Hour))
+	}
+	return creds, nil
+}
+
+// ssoCachedToken is the subset of an AWS SSO cached-login JSON file (under
+// ~/.aws/sso/cache/<sha1(startUrl)>.json) that limes needs.
+type ssoCachedToken struct {
+	AccessToken string    `json:"accessToken"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	Region      string    `json:"region"`
+	StartURL    string    `json:"startUrl"`
+}
+
+// ssoProvider exchanges a cached AWS SSO / IAM Identity Center login for
+// short-lived role credentials via sso:GetRoleCredentials. It never
+// initiates a browser login itself; the user is expected to have already
+// run `aws sso login` for the profile's start URL.
+type ssoProvider struct {
+	profile Profile
+}
+
+func (p *ssoProvider) Retrieve(ctx context.Context) (*sts.Credentials, error) {
+	token, err := loadSSOCachedToken(p.profile.SSOStartURL)
+	if err != nil {
+		return nil, err
+	}
+
+	region := p.profile.SSORegion
+	if region == "" {
+		region = token.Region
+	}
+
+	sess := session.New(&aws.Config{Region: &region})
+	ssoClient := sso.New(sess)
+
+	resp, err := ssoClient.GetRoleCredentialsWithContext(ctx, &sso.GetRoleCredentialsInput{
+		AccessToken: aws.String(token.AccessToken),
+		AccountId:   aws.String(p.profile.SSOAccountID),
+		RoleName:    aws.String(p.profile.SSORoleName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rc := resp.RoleCredentials
+	return &sts.Credentials{
+		AccessKeyId:     rc.AccessKeyId,
+		SecretAccessKey: rc.SecretAccessKey,
+		SessionToken:    rc.SessionToken,
+		Expiration:      aws.Time(time.Unix(0, *rc.Expiration*int64(time.Millisecond))),
+	}, nil
+}
+
+// loadSSOCachedToken reads the cached SSO login for startURL from
+// ~/.aws/sso/cache, keyed by the sha1 hex digest of the start URL (the same
+// scheme the AWS CLI uses).
+func loadSSOCachedToken(startURL string) (*ssoCachedToken, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(startURL))
+	cachePath := filepath.Join(home, ".aws", "sso", "cache", hex.EncodeToString(sum[:])+".json")
+
+	raw, err := os.ReadFile(cachePath)
+	if os.IsNotExist(err) {
+		return nil, errSSOTokenMissing
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var token ssoCachedToken
+	if err := json.Unmarshal(raw, &token); err != nil {
+		return nil, fmt.Errorf("parsing cached SSO token %q: %w", cachePath, err)
+	}
+
+	if time.Now().After(token.ExpiresAt) {
+		return nil, errSSOTokenExpired
+	}
+	return &token, nil
+}
+
+// ec2MetadataProvider retrieves credentials from the EC2/ECS instance
+// metadata endpoint, for profiles with `credential_source = Ec2InstanceMetadata`
+// or `EcsContainer` rather than a `source_profile`. This is the identity a
+// limes daemon running on an EC2 instance or inside an ECS task already has.
+type ec2MetadataProvider struct {
+	profile Profile
+}
+
+func (p *ec2MetadataProvider) Retrieve(ctx context.Context) (*sts.Credentials, error) {
+	sess := session.New(&aws.Config{Region: &p.profile.Region})
+	provider := ec2rolecreds.NewCredentials(sess)
+
+	value, err := provider.GetWithContext(aws.BackgroundContext())
+	if err != nil {
+		return nil, fmt.Errorf("retrieving EC2/ECS instance metadata credentials: %w", err)
+	}
+
+	// The metadata service rotates these well before they expire and the
+	// SDK provider re-fetches on demand, so a conservative fixed window is
+	// enough for limes' own refresh bookkeeping.
+	return &sts.Credentials{
+		AccessKeyId:     aws.String(value.AccessKeyID),
+		SecretAccessKey: aws.String(value.SecretAccessKey),
+		SessionToken:    aws.String(value.SessionToken),
+		Expiration:      aws.Time(time.Now().Add(1 * time.Hour)),
+	}, nil
+}
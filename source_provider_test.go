@@ -0,0 +1,103 @@
+package main
+
+import "testing"
+
+func TestSourceProviderForProfileSelectsByPrecedence(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile Profile
+		mfa     string
+		want    interface{}
+		wantErr error
+	}{
+		{
+			name:    "web identity token file",
+			profile: Profile{WebIdentityTokenFile: "/var/run/token"},
+			want:    &webIdentityProvider{},
+		},
+		{
+			name:    "web identity token command",
+			profile: Profile{WebIdentityTokenCommand: "get-token"},
+			want:    &webIdentityProvider{},
+		},
+		{
+			name:    "web identity conflicts with static keys",
+			profile: Profile{WebIdentityTokenFile: "/var/run/token", AwsAccessKeyID: "AKIA"},
+			wantErr: errWebIdentityTokenSource,
+		},
+		{
+			name:    "credential process",
+			profile: Profile{CredentialProcess: "get-creds.sh"},
+			want:    &credentialProcessProvider{},
+		},
+		{
+			name:    "sso",
+			profile: Profile{SSOStartURL: "https://example.awsapps.com/start"},
+			want:    &ssoProvider{},
+		},
+		{
+			name:    "ec2 instance metadata",
+			profile: Profile{CredentialSource: "Ec2InstanceMetadata"},
+			want:    &ec2MetadataProvider{},
+		},
+		{
+			name:    "ecs container",
+			profile: Profile{CredentialSource: "EcsContainer"},
+			want:    &ec2MetadataProvider{},
+		},
+		{
+			name:    "static keys requiring MFA",
+			profile: Profile{MFASerial: "arn:aws:iam::123456789012:mfa/jdoe"},
+			wantErr: errMFANeeded,
+		},
+		{
+			name:    "static keys with MFA supplied",
+			profile: Profile{MFASerial: "arn:aws:iam::123456789012:mfa/jdoe"},
+			mfa:     "123456",
+			want:    &staticKeysProvider{},
+		},
+		{
+			name:    "static keys fallback",
+			profile: Profile{AwsAccessKeyID: "AKIA"},
+			want:    &staticKeysProvider{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := sourceProviderForProfile(tt.profile, tt.mfa)
+			if tt.wantErr != nil {
+				if err != tt.wantErr {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			switch tt.want.(type) {
+			case *webIdentityProvider:
+				if _, ok := provider.(*webIdentityProvider); !ok {
+					t.Fatalf("provider = %T, want *webIdentityProvider", provider)
+				}
+			case *credentialProcessProvider:
+				if _, ok := provider.(*credentialProcessProvider); !ok {
+					t.Fatalf("provider = %T, want *credentialProcessProvider", provider)
+				}
+			case *ssoProvider:
+				if _, ok := provider.(*ssoProvider); !ok {
+					t.Fatalf("provider = %T, want *ssoProvider", provider)
+				}
+			case *ec2MetadataProvider:
+				if _, ok := provider.(*ec2MetadataProvider); !ok {
+					t.Fatalf("provider = %T, want *ec2MetadataProvider", provider)
+				}
+			case *staticKeysProvider:
+				if _, ok := provider.(*staticKeysProvider); !ok {
+					t.Fatalf("provider = %T, want *staticKeysProvider", provider)
+				}
+			}
+		})
+	}
+}